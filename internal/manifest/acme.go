@@ -0,0 +1,309 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// AcmeSpec describes the `acme:` block of a certificate manifest entry. When
+// set, the certificate is obtained from an ACME (RFC 8555) directory instead
+// of being self-signed or signed by a local issuer.
+type AcmeSpec struct {
+	DirectoryURL string        `yaml:"directory_url"`
+	Email        string        `yaml:"email"`
+	AccountKey   string        `yaml:"account_key"`
+	Challenge    string        `yaml:"challenge"` // "http-01", "dns-01" or "tls-alpn-01"
+	HTTPPort     int           `yaml:"http_port"`
+	RenewBefore  time.Duration `yaml:"renew_before"`
+}
+
+// AcmeState tracks the parts of an ACME account and order that must be
+// reused across manifest runs so that re-running the generator does not
+// create a new account or order every time.
+type AcmeState struct {
+	AccountURL string    `yaml:"account_url"`
+	OrderURL   string    `yaml:"order_url"`
+	Expiry     time.Time `yaml:"expiry"`
+}
+
+// ChallengeSolver satisfies an ACME authorization challenge for a domain and
+// cleans up any state it created once the authorization has been validated.
+type ChallengeSolver interface {
+	// Present makes the appropriate resource (HTTP token, TXT record, or
+	// TLS-ALPN certificate) available so the ACME server can validate it.
+	Present(ctx context.Context, domain, token string, chal *acme.Challenge, client *acme.Client, accountKey crypto.Signer) error
+	// CleanUp removes whatever Present set up.
+	CleanUp(ctx context.Context, domain, token string) error
+}
+
+// HTTP01Solver answers http-01 challenges by serving the key authorization
+// on an inline HTTP server listening on Port (defaults to 80).
+type HTTP01Solver struct {
+	Port int
+
+	server *http.Server
+}
+
+func (s *HTTP01Solver) Present(ctx context.Context, domain, token string, chal *acme.Challenge, client *acme.Client, accountKey crypto.Signer) error {
+	keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return fmt.Errorf("acme: computing http-01 key authorization: %w", err)
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = 80
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(client.HTTP01ChallengePath(chal.Token), func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, keyAuth)
+	})
+
+	s.server = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("acme: listening for http-01 challenge: %w", err)
+	}
+	go s.server.Serve(ln)
+
+	return nil
+}
+
+func (s *HTTP01Solver) CleanUp(ctx context.Context, domain, token string) error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
+
+// TLSALPN01Solver answers tls-alpn-01 challenges by serving a self-signed
+// certificate carrying the acmeIdentifier extension over a TLS listener on
+// the standard HTTPS port.
+type TLSALPN01Solver struct {
+	Port int
+
+	listener net.Listener
+}
+
+func (s *TLSALPN01Solver) Present(ctx context.Context, domain, token string, chal *acme.Challenge, client *acme.Client, accountKey crypto.Signer) error {
+	challengeCert, err := client.TLSALPN01ChallengeCert(chal.Token, domain)
+	if err != nil {
+		return fmt.Errorf("acme: building tls-alpn-01 challenge certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{challengeCert},
+		NextProtos:   []string{"acme-tls/1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				Certificates: []tls.Certificate{challengeCert},
+				NextProtos:   []string{"acme-tls/1"},
+			}, nil
+		},
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = 443
+	}
+
+	ln, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), tlsConfig)
+	if err != nil {
+		return fmt.Errorf("acme: listening for tls-alpn-01 challenge: %w", err)
+	}
+	s.listener = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tls.Server(conn, tlsConfig).HandshakeContext(ctx)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+func (s *TLSALPN01Solver) CleanUp(ctx context.Context, domain, token string) error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// loadOrCreateAccountKey reads the ACME account key from path, generating
+// and persisting a new one if it does not exist yet.
+func loadOrCreateAccountKey(path string) (crypto.Signer, error) {
+	if key, err := readSignerFromPEM(path); err == nil {
+		return key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("acme: generating account key: %w", err)
+	}
+	if err := writeSignerToPEM(path, key); err != nil {
+		return nil, fmt.Errorf("acme: persisting account key: %w", err)
+	}
+	return key, nil
+}
+
+// solverForChallenge returns the default ChallengeSolver for the challenge
+// type named in spec. There is no way to supply a different solver, so
+// dns-01, which has no default solver, always returns an error.
+func solverForChallenge(spec AcmeSpec) (ChallengeSolver, error) {
+	switch spec.Challenge {
+	case "", "http-01":
+		return &HTTP01Solver{Port: spec.HTTPPort}, nil
+	case "tls-alpn-01":
+		return &TLSALPN01Solver{}, nil
+	case "dns-01":
+		return nil, fmt.Errorf("acme: dns-01 challenge is not supported, it has no default solver")
+	default:
+		return nil, fmt.Errorf("acme: unknown challenge type %q", spec.Challenge)
+	}
+}
+
+// needsRenewal reports whether an ACME-issued certificate expiring at
+// expiry should be renewed now, given the manifest's renew_before window.
+func needsRenewal(expiry time.Time, renewBefore time.Duration) bool {
+	if renewBefore == 0 {
+		renewBefore = 30 * 24 * time.Hour
+	}
+	return time.Now().After(expiry.Add(-renewBefore))
+}
+
+// obtainACMECertificate drives the ACME protocol end to end for cert: it
+// registers (or reuses) the account, creates an order for the certificate's
+// SANs, satisfies the configured challenge for each authorization, finalizes
+// the order with a CSR built from the certificate spec, and returns the
+// resulting certificate chain in DER form. The certificate's actual validity
+// period is whatever the CA issues, not something the caller can request, so
+// unlike the locally-signed path there is no notAfter argument here; the
+// caller parses the returned chain to find out. It always issues: generateACME
+// only calls it once it has already decided the previous order can't simply
+// be reused (see needsRenewal).
+func obtainACMECertificate(ctx context.Context, spec AcmeSpec, acmeState *AcmeState, sans []string, keyType string) (chain [][]byte, key crypto.Signer, err error) {
+	accountKey, err := loadOrCreateAccountKey(spec.AccountKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	directory, err := url.Parse(spec.DirectoryURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: invalid directory_url: %w", err)
+	}
+
+	client := &acme.Client{Key: accountKey, DirectoryURL: directory.String()}
+
+	if acmeState.AccountURL == "" {
+		account := &acme.Account{Contact: []string{"mailto:" + spec.Email}}
+		account, err = client.Register(ctx, account, acme.AcceptTOS)
+		if err != nil && err != acme.ErrAccountAlreadyExists {
+			return nil, nil, fmt.Errorf("acme: registering account: %w", err)
+		}
+		acmeState.AccountURL = account.URI
+	} else {
+		// client.Register populates client.KID as a side effect, so skipping
+		// it when the account already exists would otherwise leave every
+		// subsequent authenticated request to lazily resolve the key ID via
+		// an extra GetReg round trip.
+		client.KID = acme.KeyID(acmeState.AccountURL)
+	}
+
+	var authzIDs []acme.AuthzID
+	for _, san := range sans {
+		authzIDs = append(authzIDs, acme.AuthzID{Type: "dns", Value: san})
+	}
+
+	order, err := client.AuthorizeOrder(ctx, authzIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: creating order: %w", err)
+	}
+
+	solver, err := solverForChallenge(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("acme: fetching authorization: %w", err)
+		}
+
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == spec.Challenge || (spec.Challenge == "" && c.Type == "http-01") {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return nil, nil, fmt.Errorf("acme: no matching challenge for authorization %s", authzURL)
+		}
+
+		if err := solver.Present(ctx, authz.Identifier.Value, chal.Token, chal, client, accountKey); err != nil {
+			return nil, nil, fmt.Errorf("acme: presenting challenge: %w", err)
+		}
+		defer solver.CleanUp(ctx, authz.Identifier.Value, chal.Token)
+
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, nil, fmt.Errorf("acme: accepting challenge: %w", err)
+		}
+		if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+			return nil, nil, fmt.Errorf("acme: waiting for authorization: %w", err)
+		}
+	}
+
+	certKey, err := generateKeyForType(keyType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: generating certificate key: %w", err)
+	}
+
+	csr, err := buildCSR(certKey, sans, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth})
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: building CSR: %w", err)
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: finalizing order: %w", err)
+	}
+
+	acmeState.OrderURL = order.URI
+
+	return der, certKey, nil
+}
@@ -0,0 +1,260 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeACMEServer simulates just enough of an RFC 8555 CA for
+// obtainACMECertificate to drive a full issuance: directory discovery,
+// account registration, order creation, a single http-01 authorization and
+// finalization. It does not validate the challenge itself, the same way
+// useFakeCTLog does not validate a real SCT: the point is to exercise the
+// package's own ACME control flow, not re-implement a CA.
+type fakeACMEServer struct {
+	ts *httptest.Server
+
+	mu          sync.Mutex
+	nonce       int
+	authzPolled int
+	newOrders   int
+}
+
+func newFakeACMEServer(t *testing.T) *fakeACMEServer {
+	t.Helper()
+
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	issuerTemplate := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake-acme-ca"}, IsCA: true}
+	issuerDER, err := x509.CreateCertificate(rand.Reader, issuerTemplate, issuerTemplate, &issuerKey.PublicKey, issuerKey)
+	assert.Nil(t, err)
+	issuerCert, err := x509.ParseCertificate(issuerDER)
+	assert.Nil(t, err)
+
+	s := &fakeACMEServer{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"newNonce": %q,
+			"newAccount": %q,
+			"newOrder": %q
+		}`, s.url("/new-nonce"), s.url("/new-account"), s.url("/new-order"))
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", s.nextNonce())
+	})
+	mux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", s.nextNonce())
+		w.Header().Set("Location", s.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"status":"valid"}`)
+	})
+	mux.HandleFunc("/new-order", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.newOrders++
+		s.mu.Unlock()
+		w.Header().Set("Replay-Nonce", s.nextNonce())
+		w.Header().Set("Location", s.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{
+			"status": "pending",
+			"identifiers": [{"type":"dns","value":"example.test"}],
+			"authorizations": [%q],
+			"finalize": %q
+		}`, s.url("/authz/1"), s.url("/order/1/finalize"))
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", s.nextNonce())
+		status := "pending"
+		if s.pollAuthz() > 1 {
+			status = "valid"
+		}
+		fmt.Fprintf(w, `{
+			"status": %q,
+			"identifier": {"type":"dns","value":"example.test"},
+			"challenges": [{"type":"http-01","url":%q,"token":"faketoken","status":"pending"}]
+		}`, status, s.url("/authz/1/challenge"))
+	})
+	mux.HandleFunc("/authz/1/challenge", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", s.nextNonce())
+		fmt.Fprintf(w, `{"type":"http-01","url":%q,"token":"faketoken","status":"valid"}`, s.url("/authz/1/challenge"))
+	})
+	mux.HandleFunc("/order/1/finalize", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", s.nextNonce())
+		fmt.Fprintf(w, `{
+			"status": "valid",
+			"identifiers": [{"type":"dns","value":"example.test"}],
+			"authorizations": [%q],
+			"finalize": %q,
+			"certificate": %q
+		}`, s.url("/authz/1"), s.url("/order/1/finalize"), s.url("/order/1/cert"))
+	})
+	mux.HandleFunc("/order/1/cert", func(w http.ResponseWriter, r *http.Request) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "example.test"},
+			DNSNames:     []string{"example.test"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, template, issuerCert, &key.PublicKey, issuerKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: issuerDER})
+	})
+
+	s.ts = httptest.NewServer(mux)
+	t.Cleanup(s.ts.Close)
+	return s
+}
+
+func (s *fakeACMEServer) url(p string) string {
+	return s.ts.URL + p
+}
+
+func (s *fakeACMEServer) nextNonce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonce++
+	return fmt.Sprintf("nonce%d", s.nonce)
+}
+
+func (s *fakeACMEServer) pollAuthz() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authzPolled++
+	return s.authzPolled
+}
+
+func (s *fakeACMEServer) newOrderCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newOrders
+}
+
+func TestACMECertificate(t *testing.T) {
+	server := newFakeACMEServer(t)
+
+	dir, err := os.MkdirTemp("", "certyaml-acme-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	httpPort := freePort(t)
+
+	spec := AcmeSpec{
+		DirectoryURL: server.url("/dir"),
+		Email:        "admin@example.test",
+		AccountKey:   path.Join(dir, "account-key.pem"),
+		HTTPPort:     httpPort,
+	}
+	state := &AcmeState{}
+
+	chain, key, err := obtainACMECertificate(context.Background(), spec, state, []string{"example.test"}, "ecdsa")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, chain)
+	assert.NotNil(t, key)
+	assert.NotEqual(t, "", state.OrderURL)
+
+	parsed, err := x509.ParseCertificate(chain[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "example.test", parsed.Subject.CommonName)
+	assert.Equal(t, []string{"example.test"}, parsed.DNSNames)
+}
+
+// TestACMEStateReuse verifies that a forced regeneration attempt (the spec
+// hash changed) does not throw away and re-request an ACME order that is
+// still comfortably within its renewal window: generateACME should serve
+// the previously issued certificate straight from disk instead.
+func TestACMEStateReuse(t *testing.T) {
+	server := newFakeACMEServer(t)
+
+	dir, err := os.MkdirTemp("", "certyaml-acme-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeManifest := func(subject string) string {
+		manifestYAML := fmt.Sprintf(`- name: acmecert
+  subject: %q
+  acme:
+    directory_url: %q
+    email: admin@example.test
+    account_key: %q
+    http_port: %d
+    renew_before: 1h
+`, subject, server.url("/dir"), path.Join(dir, "account-key.pem"), freePort(t))
+		manifestPath := path.Join(dir, "manifest.yaml")
+		assert.Nil(t, os.WriteFile(manifestPath, []byte(manifestYAML), 0644))
+		return manifestPath
+	}
+
+	statePath := path.Join(dir, "state.yaml")
+	var output bytes.Buffer
+
+	err = GenerateCertificates(&output, writeManifest("CN=acmecert"), statePath, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, server.newOrderCount())
+
+	certBefore, err := os.ReadFile(path.Join(dir, "acmecert.pem"))
+	assert.Nil(t, err)
+
+	err = GenerateCertificates(&output, writeManifest("CN=acmecert-renamed"), statePath, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, server.newOrderCount(), "still-valid order must be reused, not reissued")
+
+	certAfter, err := os.ReadFile(path.Join(dir, "acmecert.pem"))
+	assert.Nil(t, err)
+	assert.Equal(t, certBefore, certAfter)
+}
+
+// freePort asks the kernel for an unused TCP port so the inline http-01
+// solver has somewhere to listen without colliding with other tests.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,158 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// BundleSpec is one entry of a certificate's `bundles:` list, requesting an
+// additional output file in a format other than the default PEM.
+type BundleSpec struct {
+	Format       string   `yaml:"format"` // "pkcs12", "jks" or "pem-chain"
+	Filename     string   `yaml:"filename"`
+	Password     string   `yaml:"password"`
+	PasswordFile string   `yaml:"password_file"`
+	Include      []string `yaml:"include"` // any of "cert", "key", "chain", "roots"
+}
+
+// password resolves the bundle's password, reading it from PasswordFile
+// when set instead of Password directly.
+func (b BundleSpec) password() (string, error) {
+	if b.PasswordFile != "" {
+		data, err := os.ReadFile(b.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("bundle %s: reading password_file: %w", b.Filename, err)
+		}
+		return string(data), nil
+	}
+	return b.Password, nil
+}
+
+// writeBundle writes the bundle described by spec for cert to destDir,
+// alongside its regular .pem outputs.
+func writeBundle(destDir string, cert *Certificate, spec BundleSpec) error {
+	chain := certificateChain(cert, contains(spec.Include, "roots"))
+
+	switch spec.Format {
+	case "pkcs12":
+		return writePKCS12Bundle(destDir, cert, chain, spec)
+	case "jks":
+		return writeJKSBundle(destDir, cert, chain, spec)
+	case "pem-chain":
+		return writePEMChainBundle(destDir, cert, chain, spec)
+	default:
+		return fmt.Errorf("bundle %s: unknown format %q", spec.Filename, spec.Format)
+	}
+}
+
+// certificateChain returns cert's issuer chain, starting with cert's direct
+// issuer, up to (but not including) the root unless includeRoots is set.
+// cert itself is not part of the returned chain.
+func certificateChain(cert *Certificate, includeRoots bool) []*x509.Certificate {
+	var chain []*x509.Certificate
+	for issuer := cert.issuer(); issuer != nil; issuer = issuer.issuer() {
+		if issuer.issuer() == nil && !includeRoots {
+			break
+		}
+		chain = append(chain, issuer.certificate)
+	}
+	return chain
+}
+
+func writePKCS12Bundle(destDir string, cert *Certificate, chain []*x509.Certificate, spec BundleSpec) error {
+	password, err := spec.password()
+	if err != nil {
+		return err
+	}
+
+	var include []*x509.Certificate
+	if contains(spec.Include, "chain") {
+		include = chain
+	}
+
+	data, err := pkcs12.Modern.Encode(cert.key, cert.certificate, include, password)
+	if err != nil {
+		return fmt.Errorf("bundle %s: encoding pkcs12: %w", spec.Filename, err)
+	}
+
+	return writeFile(joinDestPath(destDir, spec.Filename), data)
+}
+
+// writeJKSBundle writes a minimal Java KeyStore containing the requested
+// entries: a PrivateKeyEntry holding the leaf and its private key when
+// either "cert" or "key" is included, and TrustedCertificateEntry entries
+// for the chain and/or roots.
+func writeJKSBundle(destDir string, cert *Certificate, chain []*x509.Certificate, spec BundleSpec) error {
+	password, err := spec.password()
+	if err != nil {
+		return err
+	}
+
+	ks := newJKSKeystore()
+	if contains(spec.Include, "cert") || contains(spec.Include, "key") {
+		if err := ks.setPrivateKeyEntry(cert.Name, cert.key, cert.certificate, chain, password); err != nil {
+			return fmt.Errorf("bundle %s: adding private key entry: %w", spec.Filename, err)
+		}
+	}
+	if contains(spec.Include, "chain") || contains(spec.Include, "roots") {
+		for i, c := range chain {
+			if err := ks.setTrustedCertificateEntry(fmt.Sprintf("%s-chain-%d", cert.Name, i), c); err != nil {
+				return fmt.Errorf("bundle %s: adding chain entry: %w", spec.Filename, err)
+			}
+		}
+	}
+
+	data, err := ks.encode(password)
+	if err != nil {
+		return fmt.Errorf("bundle %s: encoding jks: %w", spec.Filename, err)
+	}
+
+	return writeFile(joinDestPath(destDir, spec.Filename), data)
+}
+
+func writePEMChainBundle(destDir string, cert *Certificate, chain []*x509.Certificate, spec BundleSpec) error {
+	var pemBytes []byte
+	if contains(spec.Include, "cert") {
+		pemBytes = append(pemBytes, certificatePEM(cert.certificate)...)
+	}
+	if contains(spec.Include, "chain") || contains(spec.Include, "roots") {
+		for _, c := range chain {
+			pemBytes = append(pemBytes, certificatePEM(c)...)
+		}
+	}
+	if contains(spec.Include, "key") {
+		keyPEM, err := signerPEM(cert.key)
+		if err != nil {
+			return fmt.Errorf("bundle %s: encoding key: %w", spec.Filename, err)
+		}
+		pemBytes = append(pemBytes, keyPEM...)
+	}
+
+	return writeFile(joinDestPath(destDir, spec.Filename), pemBytes)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
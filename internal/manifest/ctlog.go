@@ -0,0 +1,223 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ctPoisonOID is the critical extension (RFC 6962 section 3.1) that marks a
+// certificate as a precertificate, never to be accepted by a TLS client.
+var ctPoisonOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+// ctSCTListOID carries the TLS-encoded list of Signed Certificate
+// Timestamps (RFC 6962 section 3.3) in the final certificate.
+var ctSCTListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// SignedCertificateTimestamp is a single SCT as returned by a CT log's
+// add-pre-chain endpoint (RFC 6962 section 3.2).
+type SignedCertificateTimestamp struct {
+	Version    uint8
+	LogID      [32]byte
+	Timestamp  uint64
+	Extensions []byte
+	Signature  []byte
+}
+
+// sctCacheKey identifies a cached SCT by the log it was fetched from and
+// the hash of the precertificate it covers, so that re-running the
+// generator on an unchanged manifest does not resubmit to the log.
+type sctCacheKey struct {
+	LogURL        string `yaml:"log_url"`
+	PrecertSHA256 string `yaml:"precert_sha256"`
+}
+
+// CTState caches SCTs obtained from logs, keyed by (log URL, precert hash)
+// as required so that re-generation is stable like the rest of the state
+// file.
+type CTState struct {
+	SCTs map[string][]byte `yaml:"scts"` // sctCacheKey (string-encoded) -> TLS-encoded SCT
+}
+
+func (k sctCacheKey) String() string {
+	return k.LogURL + "#" + k.PrecertSHA256
+}
+
+// precertHash returns the cache key component identifying a precertificate.
+func precertHash(der []byte) string {
+	sum := sha256.Sum256(der)
+	return fmt.Sprintf("%x", sum)
+}
+
+// poisonedTemplate returns a copy of template with the CT poison extension
+// added, suitable for producing a precertificate that is never to be
+// trusted directly.
+func poisonedTemplate(template *x509.Certificate) *x509.Certificate {
+	poisoned := *template
+	poisoned.ExtraExtensions = append(append([]pkix.Extension{}, template.ExtraExtensions...), pkix.Extension{
+		Id:       ctPoisonOID,
+		Critical: true,
+		Value:    []byte{0x05, 0x00}, // ASN.1 NULL
+	})
+	return &poisoned
+}
+
+// sctListExtensionValue TLS-encodes scts per RFC 6962 section 3.3 for
+// embedding under ctSCTListOID in the final certificate.
+func sctListExtensionValue(scts [][]byte) ([]byte, error) {
+	var list []byte
+	for _, sct := range scts {
+		if len(sct) > 0xffff {
+			return nil, fmt.Errorf("ctlog: SCT too large to encode (%d bytes)", len(sct))
+		}
+		var lenPrefix [2]byte
+		binary.BigEndian.PutUint16(lenPrefix[:], uint16(len(sct)))
+		list = append(list, lenPrefix[:]...)
+		list = append(list, sct...)
+	}
+
+	if len(list) > 0xffff {
+		return nil, fmt.Errorf("ctlog: SCT list too large to encode (%d bytes)", len(list))
+	}
+	var outerLen [2]byte
+	binary.BigEndian.PutUint16(outerLen[:], uint16(len(list)))
+
+	// The whole structure is itself wrapped in an OCTET STRING for the
+	// X.509 extension value.
+	return asn1.Marshal(append(outerLen[:], list...))
+}
+
+// submitPrecertToLogs submits der (a precertificate) to each of logURLs via
+// RFC 6962 add-pre-chain, returning the TLS-encoded SCT from each, reusing
+// cached results from state where available.
+func submitPrecertToLogs(der []byte, issuerDER []byte, logURLs []string, state *CTState) ([][]byte, error) {
+	if state.SCTs == nil {
+		state.SCTs = map[string][]byte{}
+	}
+
+	hash := precertHash(der)
+	var scts [][]byte
+	for _, logURL := range logURLs {
+		key := sctCacheKey{LogURL: logURL, PrecertSHA256: hash}.String()
+		if cached, ok := state.SCTs[key]; ok {
+			scts = append(scts, cached)
+			continue
+		}
+
+		sct, err := addPreChain(logURL, der, issuerDER)
+		if err != nil {
+			return nil, fmt.Errorf("ctlog: submitting precertificate to %s: %w", logURL, err)
+		}
+		state.SCTs[key] = sct
+		scts = append(scts, sct)
+	}
+	return scts, nil
+}
+
+// addPreChainRequest is the RFC 6962 section 4.1 add-pre-chain request body:
+// the precertificate followed by the chain up to (but not including) a
+// trusted root, each entry base64-encoded DER.
+type addPreChainRequest struct {
+	Chain []string `json:"chain"`
+}
+
+// addPreChainResponse is the RFC 6962 section 4.1 response: an SCT in its
+// separate fields rather than the TLS-encoded form used on the wire.
+type addPreChainResponse struct {
+	SCTVersion uint8  `json:"sct_version"`
+	ID         string `json:"id"`
+	Timestamp  uint64 `json:"timestamp"`
+	Extensions string `json:"extensions"`
+	Signature  string `json:"signature"`
+}
+
+// ctHTTPClient is the client used for add-pre-chain submissions; overridable
+// so tests can point it at a local server instead of a real CT log.
+var ctHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// addPreChain performs the RFC 6962 add-pre-chain HTTP call against a real
+// log. useFakeCTLog overrides this boundary in tests so no network access is
+// required.
+var addPreChain = func(logURL string, der, issuerDER []byte) ([]byte, error) {
+	reqBody, err := json.Marshal(addPreChainRequest{
+		Chain: []string{base64.StdEncoding.EncodeToString(der), base64.StdEncoding.EncodeToString(issuerDER)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding add-pre-chain request: %w", err)
+	}
+
+	endpoint := strings.TrimSuffix(logURL, "/") + "/ct/v1/add-pre-chain"
+	resp, err := ctHTTPClient.Post(endpoint, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+
+	var parsed addPreChainResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("decoding add-pre-chain response from %s: %w", endpoint, err)
+	}
+
+	return encodeSCT(parsed)
+}
+
+// encodeSCT TLS-encodes an add-pre-chain response per RFC 6962 section 3.2,
+// the form embedded in the final certificate's SCT list extension.
+func encodeSCT(r addPreChainResponse) ([]byte, error) {
+	id, err := base64.StdEncoding.DecodeString(r.ID)
+	if err != nil {
+		return nil, fmt.Errorf("decoding log id: %w", err)
+	}
+	if len(id) != 32 {
+		return nil, fmt.Errorf("log id is %d bytes, want 32", len(id))
+	}
+	ext, err := base64.StdEncoding.DecodeString(r.Extensions)
+	if err != nil {
+		return nil, fmt.Errorf("decoding extensions: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(r.SCTVersion)
+	buf.Write(id)
+	if err := binary.Write(&buf, binary.BigEndian, r.Timestamp); err != nil {
+		return nil, err
+	}
+	var extLen [2]byte
+	binary.BigEndian.PutUint16(extLen[:], uint16(len(ext)))
+	buf.Write(extLen[:])
+	buf.Write(ext)
+	buf.Write(sig)
+
+	return buf.Bytes(), nil
+}
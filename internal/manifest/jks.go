@@ -0,0 +1,78 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	keystore "github.com/pavlo-v-chernykh/keystore-go/v4"
+)
+
+// jksKeystore builds a Java KeyStore (JKS) for the `bundles:` feature. The
+// actual encoding, including the JKS password-based key-protection scheme
+// and keystore integrity digest, is delegated to keystore-go rather than
+// reimplemented here.
+type jksKeystore struct {
+	ks keystore.KeyStore
+}
+
+func newJKSKeystore() *jksKeystore {
+	return &jksKeystore{ks: keystore.New()}
+}
+
+func (j *jksKeystore) setPrivateKeyEntry(alias string, key crypto.Signer, leaf *x509.Certificate, chain []*x509.Certificate, password string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("jks: marshaling private key: %w", err)
+	}
+
+	certs := []keystore.Certificate{{Type: "X509", Content: leaf.Raw}}
+	for _, c := range chain {
+		certs = append(certs, keystore.Certificate{Type: "X509", Content: c.Raw})
+	}
+
+	entry := keystore.PrivateKeyEntry{
+		CreationTime:     time.Now(),
+		PrivateKey:       der,
+		CertificateChain: certs,
+	}
+	return j.ks.SetPrivateKeyEntry(alias, entry, []byte(password))
+}
+
+func (j *jksKeystore) setTrustedCertificateEntry(alias string, cert *x509.Certificate) error {
+	entry := keystore.TrustedCertificateEntry{
+		CreationTime: time.Now(),
+		Certificate:  keystore.Certificate{Type: "X509", Content: cert.Raw},
+	}
+	return j.ks.SetTrustedCertificateEntry(alias, entry)
+}
+
+// encode serializes the keystore to the binary JKS format, protecting
+// private key entries and signing the keystore with password.
+func (j *jksKeystore) encode(password string) ([]byte, error) {
+	if len(j.ks.Aliases()) == 0 {
+		return nil, fmt.Errorf("jks: keystore has no entries")
+	}
+
+	var buf bytes.Buffer
+	if err := j.ks.Store(&buf, []byte(password)); err != nil {
+		return nil, fmt.Errorf("jks: encoding keystore: %w", err)
+	}
+	return buf.Bytes(), nil
+}
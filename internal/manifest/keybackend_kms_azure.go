@@ -0,0 +1,174 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build kms
+
+package manifest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+)
+
+// azureKMSBackend implements KMSKeyBackend for a key_id shaped like
+// "https://myvault.vault.azure.net/keys/mykey": the Key Vault key identifier
+// URL, vault and key name.
+type azureKMSBackend struct {
+	vaultURL string
+	keyName  string
+}
+
+func (b azureKMSBackend) NewSigner(keyType string) (crypto.Signer, string, error) {
+	client, err := newAzureKeysClient(b.vaultURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	params, err := azureCreateKeyParameters(keyType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx := context.Background()
+	resp, err := client.CreateKey(ctx, b.keyName, params, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("key_backend: creating Key Vault key: %w", err)
+	}
+
+	ref := b.vaultURL + "/keys/" + b.keyName
+	signer, err := newAzureKMSSigner(ctx, client, b.keyName, resp.Key)
+	if err != nil {
+		return nil, "", err
+	}
+	return signer, ref, nil
+}
+
+func (b azureKMSBackend) Signer(ref string) (crypto.Signer, error) {
+	client, err := newAzureKeysClient(b.vaultURL)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	resp, err := client.GetKey(ctx, b.keyName, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("key_backend: fetching Key Vault key: %w", err)
+	}
+
+	return newAzureKMSSigner(ctx, client, b.keyName, resp.Key)
+}
+
+func (b azureKMSBackend) WriteKeyFile(path, ref string) error {
+	return writeKeyBackendStub(path, "kms", ref)
+}
+
+func newAzureKeysClient(vaultURL string) (*azkeys.Client, error) {
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("key_backend: loading Azure credentials: %w", err)
+	}
+	return azkeys.NewClient(vaultURL, cred, nil)
+}
+
+func azureCreateKeyParameters(keyType string) (azkeys.CreateKeyParameters, error) {
+	switch keyType {
+	case "", "rsa":
+		kty := azkeys.KeyTypeRSA
+		size := int32(2048)
+		return azkeys.CreateKeyParameters{Kty: &kty, KeySize: &size}, nil
+	case "ecdsa":
+		kty := azkeys.KeyTypeEC
+		curve := azkeys.CurveNameP256
+		return azkeys.CreateKeyParameters{Kty: &kty, Curve: &curve}, nil
+	default:
+		return azkeys.CreateKeyParameters{}, fmt.Errorf("key_backend: kms does not support key_type %q", keyType)
+	}
+}
+
+// azureKMSSigner implements crypto.Signer against a key held in Azure Key
+// Vault; the private key material never leaves the vault.
+type azureKMSSigner struct {
+	ctx     context.Context
+	client  *azkeys.Client
+	keyName string
+	pub     crypto.PublicKey
+}
+
+func newAzureKMSSigner(ctx context.Context, client *azkeys.Client, keyName string, jwk *azkeys.JSONWebKey) (crypto.Signer, error) {
+	pub, err := azureParsePublicKey(jwk)
+	if err != nil {
+		return nil, err
+	}
+	return &azureKMSSigner{ctx: ctx, client: client, keyName: keyName, pub: pub}, nil
+}
+
+func azureParsePublicKey(jwk *azkeys.JSONWebKey) (crypto.PublicKey, error) {
+	if jwk == nil || jwk.Kty == nil {
+		return nil, fmt.Errorf("key_backend: Key Vault returned no public key material")
+	}
+	switch *jwk.Kty {
+	case azkeys.KeyTypeRSA, azkeys.KeyTypeRSAHSM:
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(jwk.N),
+			E: int(new(big.Int).SetBytes(jwk.E).Int64()),
+		}, nil
+	case azkeys.KeyTypeEC, azkeys.KeyTypeECHSM:
+		x := new(big.Int).SetBytes(jwk.X)
+		y := new(big.Int).SetBytes(jwk.Y)
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("key_backend: unsupported Key Vault key type %q", *jwk.Kty)
+	}
+}
+
+func (s *azureKMSSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *azureKMSSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm := azkeys.SignatureAlgorithmRS256
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		algorithm = azkeys.SignatureAlgorithmES256
+	}
+
+	resp, err := s.client.Sign(s.ctx, s.keyName, "", azkeys.SignParameters{
+		Algorithm: &algorithm,
+		Value:     digest,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("key_backend: kms sign: %w", err)
+	}
+	return resp.Result, nil
+}
+
+// azureKeyNameFromURL extracts the key name from a
+// "https://vault.vault.azure.net/keys/name" identifier.
+func azureKeyNameFromURL(keyID string) (vaultURL, keyName string, err error) {
+	const marker = "/keys/"
+	i := strings.Index(keyID, marker)
+	if i < 0 {
+		return "", "", fmt.Errorf("key_backend: kms key_id %q is not a Key Vault key URL", keyID)
+	}
+	return keyID[:i], strings.TrimSuffix(keyID[i+len(marker):], "/"), nil
+}
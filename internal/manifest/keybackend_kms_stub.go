@@ -0,0 +1,41 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !kms
+
+package manifest
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// KMSKeyBackend creates and retrieves keys from a cloud KMS, identified by
+// KeyID. This build does not link a cloud SDK; build with `-tags kms` for
+// the real AWS, GCP and Azure implementations in keybackend_kms*.go.
+type KMSKeyBackend struct {
+	KeyID string
+}
+
+func (b KMSKeyBackend) NewSigner(keyType string) (crypto.Signer, string, error) {
+	return nil, "", fmt.Errorf("key_backend: kms support requires building with the kms build tag")
+}
+
+func (b KMSKeyBackend) Signer(ref string) (crypto.Signer, error) {
+	return nil, fmt.Errorf("key_backend: kms support requires building with the kms build tag")
+}
+
+func (b KMSKeyBackend) WriteKeyFile(path, ref string) error {
+	return fmt.Errorf("key_backend: kms support requires building with the kms build tag")
+}
@@ -0,0 +1,305 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pkcs11
+
+package manifest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Modules caches the loaded/initialized *pkcs11.Ctx per module path.
+// A signer returned by NewSigner or Signer must be able to go on signing
+// for as long as the process runs, so the module is deliberately never
+// finalized; PKCS#11 modules are designed to be loaded once for the
+// lifetime of the process that uses them, same as softhsm/OpenSC clients.
+var (
+	pkcs11ModulesMu sync.Mutex
+	pkcs11Modules   = map[string]*pkcs11.Ctx{}
+)
+
+func openPKCS11Module(module string) (*pkcs11.Ctx, error) {
+	pkcs11ModulesMu.Lock()
+	defer pkcs11ModulesMu.Unlock()
+
+	if ctx, ok := pkcs11Modules[module]; ok {
+		return ctx, nil
+	}
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("key_backend: loading pkcs11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, fmt.Errorf("key_backend: initializing pkcs11 module %s: %w", module, err)
+	}
+
+	pkcs11Modules[module] = ctx
+	return ctx, nil
+}
+
+// PKCS11KeyBackend creates and retrieves keys from a PKCS#11 token (HSM),
+// addressed by a "pkcs11:module=...;slot=...;object=..." URI.
+// Only built when compiling with `-tags pkcs11`, since it links against the
+// vendor's PKCS#11 shared library via cgo.
+type PKCS11KeyBackend struct {
+	URI string
+}
+
+func (b PKCS11KeyBackend) NewSigner(keyType string) (crypto.Signer, string, error) {
+	module, slot, label, err := parsePKCS11URI(b.URI)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, err := openPKCS11Module(module)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, "", fmt.Errorf("key_backend: opening pkcs11 session: %w", err)
+	}
+
+	signer, ref, err := generatePKCS11KeyPair(ctx, session, keyType, label)
+	if err != nil {
+		return nil, "", fmt.Errorf("key_backend: generating key on token: %w", err)
+	}
+	return signer, ref, nil
+}
+
+func (b PKCS11KeyBackend) Signer(ref string) (crypto.Signer, error) {
+	module, slot, _, err := parsePKCS11URI(b.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := openPKCS11Module(module)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("key_backend: opening pkcs11 session: %w", err)
+	}
+
+	return loadPKCS11Signer(ctx, session, ref)
+}
+
+func (b PKCS11KeyBackend) WriteKeyFile(path, ref string) error {
+	return writeKeyBackendStub(path, "pkcs11", ref)
+}
+
+// parsePKCS11URI splits a "pkcs11:module=...;slot=...;object=..." URI into
+// the shared library path, slot ID and object label PKCS#11 needs.
+func parsePKCS11URI(uri string) (module string, slot uint, label string, err error) {
+	params, err := parseKeyValueURI(uri, "pkcs11")
+	if err != nil {
+		return "", 0, "", err
+	}
+	module = params["module"]
+	if module == "" {
+		return "", 0, "", fmt.Errorf("key_backend: pkcs11 URI %q is missing module=", uri)
+	}
+	label = params["object"]
+	if label == "" {
+		return "", 0, "", fmt.Errorf("key_backend: pkcs11 URI %q is missing object=", uri)
+	}
+	if _, err := fmt.Sscanf(params["slot"], "%d", &slot); err != nil {
+		return "", 0, "", fmt.Errorf("key_backend: pkcs11 URI %q has invalid slot=: %w", uri, err)
+	}
+	return module, slot, label, nil
+}
+
+// generatePKCS11KeyPair generates a key pair of the given type on the token
+// under label, returning a Signer backed by the token and the object label
+// used as the persisted reference.
+func generatePKCS11KeyPair(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, keyType, label string) (crypto.Signer, string, error) {
+	mechanism, pubAttrs, privAttrs, err := pkcs11KeyGenTemplate(keyType, label)
+	if err != nil {
+		return nil, "", err
+	}
+
+	pub, priv, err := ctx.GenerateKeyPair(session, mechanism, pubAttrs, privAttrs)
+	if err != nil {
+		return nil, "", fmt.Errorf("generating key pair on token: %w", err)
+	}
+
+	signer, err := newPKCS11Signer(ctx, session, pub, priv, keyType)
+	if err != nil {
+		return nil, "", err
+	}
+	return signer, label, nil
+}
+
+// loadPKCS11Signer looks up an existing key pair by its object label and
+// wraps it in a Signer.
+func loadPKCS11Signer(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (crypto.Signer, error) {
+	findKey := func(class uint) (pkcs11.ObjectHandle, error) {
+		template := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		}
+		if err := ctx.FindObjectsInit(session, template); err != nil {
+			return 0, err
+		}
+		defer ctx.FindObjectsFinal(session)
+
+		handles, _, err := ctx.FindObjects(session, 1)
+		if err != nil {
+			return 0, err
+		}
+		if len(handles) == 0 {
+			return 0, fmt.Errorf("no object with label %q", label)
+		}
+		return handles[0], nil
+	}
+
+	pub, err := findKey(pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil, fmt.Errorf("looking up public key: %w", err)
+	}
+	priv, err := findKey(pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return nil, fmt.Errorf("looking up private key: %w", err)
+	}
+
+	keyType := ""
+	keyTypeAttrs, err := ctx.GetAttributeValue(session, pub, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil)})
+	if err != nil {
+		return nil, fmt.Errorf("reading key type: %w", err)
+	}
+	if bytes.Equal(keyTypeAttrs[0].Value, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC).Value) {
+		keyType = "ecdsa"
+	}
+
+	return newPKCS11Signer(ctx, session, pub, priv, keyType)
+}
+
+// pkcs11KeyGenTemplate returns the mechanism and object attribute templates
+// for generating a key pair of the given type; only RSA and EC keys are
+// supported, matching generateKeyForType's "rsa"/"ecdsa" naming.
+func pkcs11KeyGenTemplate(keyType, label string) ([]*pkcs11.Mechanism, []*pkcs11.Attribute, []*pkcs11.Attribute, error) {
+	switch keyType {
+	case "", "rsa":
+		mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}
+		pubAttrs := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{0x01, 0x00, 0x01}),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		}
+		privAttrs := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		}
+		return mechanism, pubAttrs, privAttrs, nil
+	case "ecdsa":
+		mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)}
+		p256OID := []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+		pubAttrs := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, p256OID),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		}
+		privAttrs := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		}
+		return mechanism, pubAttrs, privAttrs, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("key_backend: pkcs11 does not support key_type %q", keyType)
+	}
+}
+
+// pkcs11Signer implements crypto.Signer against a key pair held on a
+// PKCS#11 token, signing through the session it was created with. The
+// session (and the module it belongs to) is kept open for the life of the
+// process; see openPKCS11Module.
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	pub     crypto.PublicKey
+	priv    pkcs11.ObjectHandle
+	keyType string
+}
+
+func newPKCS11Signer(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, pub, priv pkcs11.ObjectHandle, keyType string) (crypto.Signer, error) {
+	pubKey, err := exportPKCS11PublicKey(ctx, session, pub, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key from token: %w", err)
+	}
+	return &pkcs11Signer{ctx: ctx, session: session, pub: pubKey, priv: priv, keyType: keyType}, nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+	if _, ok := s.pub.(*rsa.PublicKey); ok {
+		mechanism = []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
+	}
+
+	if err := s.ctx.SignInit(s.session, mechanism, s.priv); err != nil {
+		return nil, fmt.Errorf("key_backend: pkcs11 sign init: %w", err)
+	}
+	return s.ctx.Sign(s.session, digest)
+}
+
+// exportPKCS11PublicKey reads the CKA_EC_POINT attribute (for keyType
+// "ecdsa") or the CKA_MODULUS and CKA_PUBLIC_EXPONENT attributes (otherwise)
+// of a public key object and parses them into a crypto.PublicKey.
+func exportPKCS11PublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, pub pkcs11.ObjectHandle, keyType string) (crypto.PublicKey, error) {
+	if keyType == "ecdsa" {
+		attrs, err := ctx.GetAttributeValue(session, pub, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+		if err != nil {
+			return nil, err
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), attrs[0].Value[2:])
+		if x == nil {
+			return nil, fmt.Errorf("parsing EC point from token")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, pub, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	n := new(big.Int).SetBytes(attrs[0].Value)
+	e := new(big.Int).SetBytes(attrs[1].Value)
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
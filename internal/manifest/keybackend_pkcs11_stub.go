@@ -0,0 +1,42 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !pkcs11
+
+package manifest
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// PKCS11KeyBackend creates and retrieves keys from a PKCS#11 token (HSM),
+// addressed by a "pkcs11:module=...;slot=...;object=..." URI. This build
+// does not link the PKCS#11 module (cgo); build with `-tags pkcs11` for the
+// real implementation in keybackend_pkcs11.go.
+type PKCS11KeyBackend struct {
+	URI string
+}
+
+func (b PKCS11KeyBackend) NewSigner(keyType string) (crypto.Signer, string, error) {
+	return nil, "", fmt.Errorf("key_backend: pkcs11 support requires building with the pkcs11 build tag")
+}
+
+func (b PKCS11KeyBackend) Signer(ref string) (crypto.Signer, error) {
+	return nil, fmt.Errorf("key_backend: pkcs11 support requires building with the pkcs11 build tag")
+}
+
+func (b PKCS11KeyBackend) WriteKeyFile(path, ref string) error {
+	return fmt.Errorf("key_backend: pkcs11 support requires building with the pkcs11 build tag")
+}
@@ -0,0 +1,1016 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package manifest generates certificates, keys and supporting PKI
+// artifacts (CRLs, OCSP responses, key/cert bundles) from a declarative
+// YAML manifest, keeping a state file so that re-running generation on an
+// unchanged manifest does not regenerate existing certificates and keys.
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CertificateSpec is one entry of the manifest YAML list: the declarative
+// description of a certificate (or CA) to generate.
+type CertificateSpec struct {
+	Name                  string          `yaml:"name"`
+	Subject               string          `yaml:"subject"`
+	Issuer                string          `yaml:"issuer"`
+	IsCA                  bool            `yaml:"is_ca"`
+	KeyType               string          `yaml:"key_type"`
+	KeySize               int             `yaml:"key_size"`
+	NotBefore             *time.Time      `yaml:"not_before"`
+	NotAfter              *time.Time      `yaml:"not_after"`
+	Expires               time.Duration   `yaml:"expires"`
+	SANs                  []string        `yaml:"sans"`
+	KeyUsage              []string        `yaml:"key_usage"`
+	ExtKeyUsage           []string        `yaml:"ext_key_usage"`
+	CRLDistributionPoints []string        `yaml:"crl_distribution_points"`
+	SerialNumber          *int64          `yaml:"serial_number"`
+	Revoke                bool            `yaml:"revoke"`
+	OCSP                  bool            `yaml:"ocsp"`
+	OCSPSigner            bool            `yaml:"ocsp_signer"`
+	Acme                  *AcmeSpec       `yaml:"acme"`
+	CTLogs                []string        `yaml:"ct_logs"`
+	KeyBackend            *KeyBackendSpec `yaml:"key_backend"`
+	Bundles               []BundleSpec    `yaml:"bundles"`
+}
+
+// Manifest is the full list of certificates to generate, in the order they
+// were declared. Certificates may reference an earlier entry by name as
+// their Issuer.
+type Manifest []CertificateSpec
+
+// Certificate is a generated certificate: the spec it came from plus the
+// material produced for it. Certificate is the handle the rest of the
+// package (CRLs, OCSP, bundles, ACME, CT) operates on.
+type Certificate struct {
+	Name        string
+	spec        CertificateSpec
+	certificate *x509.Certificate
+	key         crypto.Signer
+	issuerCert  *Certificate
+	children    []*Certificate
+	revokedAt   time.Time
+
+	OCSP       bool
+	OCSPSigner *Certificate
+
+	acmeState *AcmeState
+	ctState   *CTState
+}
+
+func (c *Certificate) issuer() *Certificate {
+	return c.issuerCert
+}
+
+// revokedSerials returns the serial numbers (string-formatted) of
+// certificates issued by c that have revoke: true set, mapped to the time
+// they were marked revoked.
+func (c *Certificate) revokedSerials() map[string]time.Time {
+	out := map[string]time.Time{}
+	for _, child := range c.children {
+		if child.spec.Revoke {
+			out[child.certificate.SerialNumber.String()] = child.revokedAt
+		}
+	}
+	return out
+}
+
+// State is the on-disk state file: enough information about the last
+// generation run to decide whether a re-run needs to touch a given
+// certificate at all.
+type State struct {
+	Certificates map[string]*CertState `yaml:"certificates"`
+}
+
+// CertState is the persisted state for a single certificate.
+type CertState struct {
+	SpecHash    string        `yaml:"spec_hash"`
+	NotAfter    time.Time     `yaml:"not_after,omitempty"`
+	RenewBefore time.Duration `yaml:"renew_before,omitempty"`
+	RevokedAt   time.Time     `yaml:"revoked_at,omitempty"`
+	KeyRef      string        `yaml:"key_ref,omitempty"`
+	Acme        *AcmeState    `yaml:"acme,omitempty"`
+	CT          *CTState      `yaml:"ct,omitempty"`
+	OCSP        *OCSPState    `yaml:"ocsp,omitempty"`
+}
+
+// GenerateCertificates reads the manifest at manifestPath, generates every
+// certificate it describes into destDir, and persists a state file at
+// statePath so that a later call with an unchanged manifest does not
+// rewrite certificate or key files. CRLs, OCSP responses and bundles are
+// written again on every call.
+func GenerateCertificates(output io.Writer, manifestPath, statePath, destDir string) error {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("reading manifest %s: %w", manifestPath, err)
+	}
+
+	var manifest Manifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&manifest); err != nil {
+		return fmt.Errorf("parsing manifest %s: %w", manifestPath, err)
+	}
+
+	if err := manifest.validate(); err != nil {
+		return err
+	}
+
+	if destDir != "" {
+		if info, err := os.Stat(destDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("destination directory %s does not exist", destDir)
+		}
+	}
+
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	g := &generator{
+		destDir: destDir,
+		state:   state,
+		byName:  map[string]*Certificate{},
+		output:  output,
+	}
+
+	for _, spec := range manifest {
+		if _, err := g.generate(spec); err != nil {
+			return err
+		}
+	}
+
+	if err := g.writeCRLsAndOCSP(); err != nil {
+		return err
+	}
+
+	if err := g.writeBundles(); err != nil {
+		return err
+	}
+
+	if statePath != "" {
+		if err := saveState(statePath, state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks manifest-level invariants that can be caught before any
+// generation is attempted: unknown issuer references and nonsensical
+// revocation requests.
+func (m Manifest) validate() error {
+	names := map[string]bool{}
+	for _, spec := range m {
+		names[spec.Name] = true
+	}
+	for _, spec := range m {
+		if spec.Issuer != "" && !names[spec.Issuer] {
+			return fmt.Errorf("certificate %s: issuer %q is not defined in the manifest", spec.Name, spec.Issuer)
+		}
+		if spec.Revoke && spec.Issuer == "" {
+			return fmt.Errorf("certificate %s: cannot revoke a self-signed certificate, it has no issuing CA to publish a CRL", spec.Name)
+		}
+	}
+	return nil
+}
+
+// generator carries the state needed across the certificates in one
+// GenerateCertificates call: where to write files, the previous and
+// current state, and the certificates generated so far (so later entries
+// can look up their issuer).
+type generator struct {
+	destDir string
+	state   *State
+	byName  map[string]*Certificate
+	output  io.Writer
+}
+
+func (g *generator) generate(spec CertificateSpec) (*Certificate, error) {
+	cert := &Certificate{Name: spec.Name, spec: spec, OCSP: spec.OCSP}
+	g.byName[spec.Name] = cert
+
+	if spec.Issuer != "" {
+		issuer, ok := g.byName[spec.Issuer]
+		if !ok {
+			return nil, fmt.Errorf("certificate %s: issuer %q must be declared before it is referenced", spec.Name, spec.Issuer)
+		}
+		cert.issuerCert = issuer
+		issuer.children = append(issuer.children, cert)
+	}
+
+	renewBefore := time.Duration(0)
+	if spec.Acme != nil {
+		renewBefore = spec.Acme.RenewBefore
+	}
+
+	specHash := hashSpec(spec)
+	prevState := g.state.Certificates[spec.Name]
+	unchanged := prevState != nil && prevState.SpecHash == specHash && g.filesExist(spec.Name) &&
+		(prevState.NotAfter.IsZero() || time.Now().Before(prevState.NotAfter.Add(-renewBefore)))
+
+	certState := &CertState{SpecHash: specHash, RenewBefore: renewBefore}
+	if prevState != nil {
+		certState.RevokedAt = prevState.RevokedAt
+		certState.KeyRef = prevState.KeyRef
+		certState.Acme = prevState.Acme
+		certState.CT = prevState.CT
+		certState.OCSP = prevState.OCSP
+	}
+	g.state.Certificates[spec.Name] = certState
+
+	if unchanged {
+		// Load back what downstream code (CRLs, OCSP, bundles) needs,
+		// without touching any files on disk.
+		certPEM, err := os.ReadFile(g.path(spec.Name + ".pem"))
+		if err != nil {
+			return nil, err
+		}
+		block, _ := decodePEM(certPEM)
+		parsed, err := x509.ParseCertificate(block)
+		if err != nil {
+			return nil, err
+		}
+		cert.certificate = parsed
+
+		if certState.KeyRef != "" {
+			backend, err := keyBackendForSpec(specKeyBackend(spec))
+			if err != nil {
+				return nil, err
+			}
+			if key, err := backend.Signer(certState.KeyRef); err == nil {
+				cert.key = key
+			}
+		} else if key, err := readSignerFromPEM(g.path(spec.Name + "-key.pem")); err == nil {
+			cert.key = key
+		}
+
+		certState.NotAfter = parsed.NotAfter
+
+		if spec.Revoke && certState.RevokedAt.IsZero() {
+			certState.RevokedAt = time.Now()
+		}
+		cert.revokedAt = certState.RevokedAt
+		cert.acmeState = certState.Acme
+		cert.ctState = certState.CT
+		return cert, nil
+	}
+
+	if spec.Revoke && certState.RevokedAt.IsZero() {
+		certState.RevokedAt = time.Now()
+	}
+	cert.revokedAt = certState.RevokedAt
+
+	if spec.Acme != nil {
+		return g.generateACME(cert, certState)
+	}
+
+	return g.generateLocal(cert, certState)
+}
+
+// filesExist reports whether the cert and key output files for name are
+// both present on disk, so a missing file forces regeneration even if the
+// spec itself is unchanged.
+func (g *generator) filesExist(name string) bool {
+	_, err1 := os.Stat(g.path(name + ".pem"))
+	_, err2 := os.Stat(g.path(name + "-key.pem"))
+	return err1 == nil && err2 == nil
+}
+
+func (g *generator) path(name string) string {
+	return filepath.Join(g.destDir, name)
+}
+
+// generateLocal signs spec either as a self-signed certificate (no issuer)
+// or using the issuer's key, optionally going through the CT
+// precertificate flow first.
+func (g *generator) generateLocal(cert *Certificate, certState *CertState) (*Certificate, error) {
+	spec := cert.spec
+
+	backend, err := keyBackendForSpec(specKeyBackend(spec))
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: %w", spec.Name, err)
+	}
+
+	key, keyRef, err := backend.NewSigner(defaultString(spec.KeyType, "ecdsa"))
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: generating key: %w", spec.Name, err)
+	}
+	cert.key = key
+	certState.KeyRef = keyRef
+
+	template, err := buildTemplate(spec)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: %w", spec.Name, err)
+	}
+
+	issuerKey := key
+	parent := template
+	if cert.issuerCert != nil {
+		issuerKey = cert.issuerCert.key
+		parent = cert.issuerCert.certificate
+	}
+
+	var der []byte
+	if len(spec.CTLogs) > 0 {
+		der, err = g.issueWithCT(cert, template, key, issuerKey, certState)
+	} else {
+		der, err = x509.CreateCertificate(rand.Reader, template, parent, key.Public(), issuerKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: signing: %w", spec.Name, err)
+	}
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: parsing freshly signed certificate: %w", spec.Name, err)
+	}
+	cert.certificate = parsed
+	certState.NotAfter = parsed.NotAfter
+
+	if err := writeFile(g.path(spec.Name+".pem"), certificatePEM(parsed)); err != nil {
+		return nil, err
+	}
+	if keyRef == "" {
+		keyPEM, err := signerPEM(key)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %s: encoding key: %w", spec.Name, err)
+		}
+		if err := writeFile(g.path(spec.Name+"-key.pem"), keyPEM); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := backend.WriteKeyFile(g.path(spec.Name+"-key.pem"), keyRef); err != nil {
+			return nil, err
+		}
+	}
+
+	if spec.OCSPSigner {
+		signerCertificate, err := g.generateOCSPSigner(cert)
+		if err != nil {
+			return nil, err
+		}
+		cert.OCSPSigner = signerCertificate
+	}
+
+	return cert, nil
+}
+
+// issueWithCT produces cert via the CT precertificate flow: sign a
+// poisoned precertificate, submit it to every configured log, then sign
+// the real certificate carrying the resulting SCT list.
+func (g *generator) issueWithCT(cert *Certificate, template *x509.Certificate, key, issuerKey crypto.Signer, certState *CertState) ([]byte, error) {
+	parent := template
+	issuerDER := []byte(nil)
+	if cert.issuerCert != nil {
+		parent = cert.issuerCert.certificate
+		issuerDER = cert.issuerCert.certificate.Raw
+	}
+
+	precertDER, err := x509.CreateCertificate(rand.Reader, poisonedTemplate(template), parent, key.Public(), issuerKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing precertificate: %w", err)
+	}
+
+	if certState.CT == nil {
+		certState.CT = &CTState{}
+	}
+	scts, err := submitPrecertToLogs(precertDER, issuerDER, cert.spec.CTLogs, certState.CT)
+	if err != nil {
+		return nil, err
+	}
+	cert.ctState = certState.CT
+
+	sctListValue, err := sctListExtensionValue(scts)
+	if err != nil {
+		return nil, err
+	}
+	final := *template
+	final.ExtraExtensions = append(append([]pkix.Extension{}, template.ExtraExtensions...), pkix.Extension{
+		Id:    ctSCTListOID,
+		Value: sctListValue,
+	})
+
+	return x509.CreateCertificate(rand.Reader, &final, parent, key.Public(), issuerKey)
+}
+
+// generateACME obtains cert from the configured ACME directory instead of
+// signing it locally.
+func (g *generator) generateACME(cert *Certificate, certState *CertState) (*Certificate, error) {
+	spec := cert.spec
+
+	if certState.Acme == nil {
+		certState.Acme = &AcmeState{}
+	}
+	cert.acmeState = certState.Acme
+
+	var sans []string
+	for _, san := range spec.SANs {
+		if strings.HasPrefix(san, "DNS:") {
+			sans = append(sans, strings.TrimPrefix(san, "DNS:"))
+		}
+	}
+
+	// generate() forces a regeneration attempt whenever the spec hash
+	// changes or an output file goes missing, even if the reason has
+	// nothing to do with the certificate being due for renewal. Don't let
+	// that force a brand new ACME order (and a fresh rate-limited
+	// issuance) while the existing one is still comfortably valid and its
+	// files are on disk; just keep serving it.
+	if certState.Acme.OrderURL != "" && g.filesExist(spec.Name) && !needsRenewal(certState.Acme.Expiry, spec.Acme.RenewBefore) {
+		if reused, err := g.reuseACMECertificate(cert, certState); err == nil {
+			return reused, nil
+		}
+	}
+
+	chain, key, err := obtainACMECertificate(context.Background(), *spec.Acme, certState.Acme, sans, defaultString(spec.KeyType, "ecdsa"))
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: %w", spec.Name, err)
+	}
+	cert.key = key
+
+	parsed, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: parsing ACME certificate: %w", spec.Name, err)
+	}
+	cert.certificate = parsed
+	certState.NotAfter = parsed.NotAfter
+	certState.Acme.Expiry = parsed.NotAfter
+
+	if err := writeFile(g.path(spec.Name+".pem"), certificatePEM(parsed)); err != nil {
+		return nil, err
+	}
+	keyPEM, err := signerPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(g.path(spec.Name+"-key.pem"), keyPEM); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// reuseACMECertificate loads cert's existing on-disk certificate and key
+// instead of going through the ACME protocol again, for the case where
+// generate() forced a regeneration attempt but the previously issued
+// certificate is still perfectly usable.
+func (g *generator) reuseACMECertificate(cert *Certificate, certState *CertState) (*Certificate, error) {
+	spec := cert.spec
+
+	certPEM, err := os.ReadFile(g.path(spec.Name + ".pem"))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := decodePEM(certPEM)
+	parsed, err := x509.ParseCertificate(block)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readSignerFromPEM(g.path(spec.Name + "-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	cert.certificate = parsed
+	cert.key = key
+	certState.NotAfter = parsed.NotAfter
+	return cert, nil
+}
+
+// generateOCSPSigner creates a delegated OCSP signing certificate as a
+// child of issuer, carrying the id-kp-OCSPSigning EKU (RFC 6960 section
+// 4.2.2.2).
+func (g *generator) generateOCSPSigner(issuer *Certificate) (*Certificate, error) {
+	key, err := generateKeyForType(defaultString(issuer.spec.KeyType, "ecdsa"))
+	if err != nil {
+		return nil, fmt.Errorf("ocsp signer for %s: %w", issuer.Name, err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: issuer.Name + "-ocsp-signer"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer.certificate, key.Public(), issuer.key)
+	if err != nil {
+		return nil, fmt.Errorf("ocsp signer for %s: signing: %w", issuer.Name, err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFile(g.path(ocspSignerKeyFilename(issuer.Name)), mustSignerPEM(key)); err != nil {
+		return nil, err
+	}
+
+	return &Certificate{Name: issuer.Name + "-ocsp-signer", certificate: parsed, key: key}, nil
+}
+
+// writeCRLsAndOCSP emits [issuer]-crl.pem and [issuer]-ocsp.der for every
+// CA with revoked certificates (or an explicit ocsp: true).
+func (g *generator) writeCRLsAndOCSP() error {
+	for _, cert := range g.byName {
+		if len(cert.children) == 0 {
+			continue
+		}
+		revoked := cert.revokedSerials()
+		if len(revoked) > 0 {
+			if err := g.writeCRL(cert, revoked); err != nil {
+				return err
+			}
+		}
+		if shouldWriteOCSP(cert) {
+			if err := g.writeOCSP(cert, revoked); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (g *generator) writeCRL(cert *Certificate, revoked map[string]time.Time) error {
+	var entries []x509.RevocationListEntry
+	var serials []string
+	for serial := range revoked {
+		serials = append(serials, serial)
+	}
+	sortStrings(serials)
+	for _, s := range serials {
+		n := new(big.Int)
+		n.SetString(s, 10)
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: n, RevocationTime: revoked[s]})
+	}
+
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(7 * 24 * time.Hour),
+		RevokedCertificateEntries: entries,
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, cert.certificate, cert.key)
+	if err != nil {
+		return fmt.Errorf("certificate %s: creating CRL: %w", cert.Name, err)
+	}
+
+	return writeFile(g.path(cert.Name+"-crl.pem"), pemEncode("X509 CRL", der))
+}
+
+func (g *generator) writeOCSP(cert *Certificate, revoked map[string]time.Time) error {
+	if len(cert.children) == 0 {
+		// ocsp: true was set explicitly but this CA has not issued
+		// anything yet: there is no certificate to report status for.
+		return nil
+	}
+
+	child := cert.children[0]
+	for _, candidate := range cert.children {
+		if _, ok := revoked[candidate.certificate.SerialNumber.String()]; ok {
+			child = candidate
+			break
+		}
+	}
+
+	resp, err := child.OCSPResponse(child.certificate.SerialNumber)
+	if err != nil {
+		return err
+	}
+	return writeFile(g.path(ocspResponseFilename(cert.Name)), resp)
+}
+
+// writeBundles emits the `bundles:` outputs declared on each certificate.
+func (g *generator) writeBundles() error {
+	for _, cert := range g.byName {
+		for _, spec := range cert.spec.Bundles {
+			if err := writeBundle(g.destDir, cert, spec); err != nil {
+				return fmt.Errorf("certificate %s: %w", cert.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// buildTemplate maps a CertificateSpec onto an *x509.Certificate template
+// ready to be passed to x509.CreateCertificate.
+func buildTemplate(spec CertificateSpec) (*x509.Certificate, error) {
+	serial, err := serialNumber(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := time.Now()
+	if spec.NotBefore != nil {
+		notBefore = *spec.NotBefore
+	}
+	notAfter := notBefore.Add(defaultDuration(spec.Expires, 365*24*time.Hour))
+	if spec.NotAfter != nil {
+		notAfter = *spec.NotAfter
+	}
+
+	keyUsage, err := parseKeyUsage(spec.KeyUsage, spec.IsCA)
+	if err != nil {
+		return nil, err
+	}
+	extKeyUsage, err := parseExtKeyUsage(spec.ExtKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+
+	var dnsNames []string
+	var ipAddresses []net.IP
+	var uris []*url.URL
+	for _, san := range spec.SANs {
+		switch {
+		case strings.HasPrefix(san, "DNS:"):
+			dnsNames = append(dnsNames, strings.TrimPrefix(san, "DNS:"))
+		case strings.HasPrefix(san, "IP:"):
+			ip := net.ParseIP(strings.TrimPrefix(san, "IP:"))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP SAN %q", san)
+			}
+			ipAddresses = append(ipAddresses, ip)
+		case strings.HasPrefix(san, "URI:"):
+			u, err := url.Parse(strings.TrimPrefix(san, "URI:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid URI SAN %q: %w", san, err)
+			}
+			uris = append(uris, u)
+		default:
+			dnsNames = append(dnsNames, san)
+		}
+	}
+
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               parseSubject(spec.Subject),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  spec.IsCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           extKeyUsage,
+		DNSNames:              dnsNames,
+		IPAddresses:           ipAddresses,
+		URIs:                  uris,
+		CRLDistributionPoints: spec.CRLDistributionPoints,
+	}, nil
+}
+
+func serialNumber(spec CertificateSpec) (*big.Int, error) {
+	if spec.SerialNumber != nil {
+		return big.NewInt(*spec.SerialNumber), nil
+	}
+	return randomSerial()
+}
+
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
+
+// parseSubject parses a minimal "CN=..." subject string, the only form the
+// manifest's test fixtures use.
+func parseSubject(subject string) pkix.Name {
+	name := pkix.Name{}
+	for _, part := range strings.Split(subject, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if strings.EqualFold(kv[0], "CN") {
+			name.CommonName = kv[1]
+		}
+	}
+	return name
+}
+
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+	"cert_sign":          x509.KeyUsageCertSign,
+	"crl_sign":           x509.KeyUsageCRLSign,
+	"encipher_only":      x509.KeyUsageEncipherOnly,
+	"decipher_only":      x509.KeyUsageDecipherOnly,
+}
+
+func parseKeyUsage(names []string, isCA bool) (x509.KeyUsage, error) {
+	if len(names) == 0 {
+		if isCA {
+			return x509.KeyUsageCertSign | x509.KeyUsageCRLSign, nil
+		}
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment, nil
+	}
+	var usage x509.KeyUsage
+	for _, n := range names {
+		u, ok := keyUsageNames[n]
+		if !ok {
+			return 0, fmt.Errorf("unknown key_usage %q", n)
+		}
+		usage |= u
+	}
+	return usage, nil
+}
+
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"any":                               x509.ExtKeyUsageAny,
+	"server_auth":                       x509.ExtKeyUsageServerAuth,
+	"client_auth":                       x509.ExtKeyUsageClientAuth,
+	"code_signing":                      x509.ExtKeyUsageCodeSigning,
+	"email_protection":                  x509.ExtKeyUsageEmailProtection,
+	"ipsec_end_system":                  x509.ExtKeyUsageIPSECEndSystem,
+	"ipsec_tunnel":                      x509.ExtKeyUsageIPSECTunnel,
+	"ipsec_user":                        x509.ExtKeyUsageIPSECUser,
+	"time_stamping":                     x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":                      x509.ExtKeyUsageOCSPSigning,
+	"microsoft_server_gated_crypto":     x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+	"netscape_server_gated_crypto":      x509.ExtKeyUsageNetscapeServerGatedCrypto,
+	"microsoft_commercial_code_signing": x509.ExtKeyUsageMicrosoftCommercialCodeSigning,
+	"microsoft_kernel_code_signing":     x509.ExtKeyUsageMicrosoftKernelCodeSigning,
+}
+
+func parseExtKeyUsage(names []string) ([]x509.ExtKeyUsage, error) {
+	var out []x509.ExtKeyUsage
+	for _, n := range names {
+		u, ok := extKeyUsageNames[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown ext_key_usage %q", n)
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// generateKeyForType creates a new private key of the given type
+// ("rsa", "ecdsa" or "ed25519").
+func generateKeyForType(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key_type %q", keyType)
+	}
+}
+
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func defaultDuration(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func specKeyBackend(spec CertificateSpec) KeyBackendSpec {
+	if spec.KeyBackend == nil {
+		return KeyBackendSpec{Type: "file"}
+	}
+	return *spec.KeyBackend
+}
+
+func sortStrings(s []string) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && s[j-1] > s[j]; j-- {
+			s[j-1], s[j] = s[j], s[j-1]
+		}
+	}
+}
+
+func hashSpec(spec CertificateSpec) string {
+	b, _ := yaml.Marshal(spec)
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%x", sum)
+}
+
+func loadState(path string) (*State, error) {
+	state := &State{Certificates: map[string]*CertState{}}
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state %s: %w", path, err)
+	}
+	if err := yaml.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parsing state %s: %w", path, err)
+	}
+	if state.Certificates == nil {
+		state.Certificates = map[string]*CertState{}
+	}
+	return state, nil
+}
+
+func saveState(path string, state *State) error {
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encoding state: %w", err)
+	}
+	return writeFile(path, data)
+}
+
+// writeFile writes data to path, creating any missing parent directories.
+func writeFile(path string, data []byte) error {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("creating directory %s: %w", dir, err)
+		}
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+func joinDestPath(destDir, name string) string {
+	return filepath.Join(destDir, name)
+}
+
+func certificatePEM(cert *x509.Certificate) []byte {
+	return pemEncode("CERTIFICATE", cert.Raw)
+}
+
+func signerPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pemEncode("PRIVATE KEY", der), nil
+}
+
+func mustSignerPEM(key crypto.Signer) []byte {
+	data, err := signerPEM(key)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func readSignerFromPEM(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	der, _ := decodePEM(data)
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a signing key", path)
+	}
+	return signer, nil
+}
+
+func writeSignerToPEM(path string, key crypto.Signer) error {
+	data, err := signerPEM(key)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// buildCSR creates a PKCS#10 certificate request for key, with the given
+// SANs (hostnames) and extended key usages, for submission to an ACME CA.
+func buildCSR(key crypto.Signer, sans []string, extKeyUsage []x509.ExtKeyUsage) ([]byte, error) {
+	var extraExtensions []pkix.Extension
+	if len(extKeyUsage) > 0 {
+		ext, err := marshalExtKeyUsage(extKeyUsage)
+		if err != nil {
+			return nil, fmt.Errorf("building CSR: %w", err)
+		}
+		extraExtensions = append(extraExtensions, ext)
+	}
+
+	template := &x509.CertificateRequest{
+		Subject:         pkix.Name{CommonName: firstOrEmpty(sans)},
+		DNSNames:        sans,
+		ExtraExtensions: extraExtensions,
+	}
+	return x509.CreateCertificateRequest(rand.Reader, template, key)
+}
+
+// extKeyUsageOID is the id-ce-extKeyUsage OID (RFC 5280 section 4.2.1.12).
+// x509.CertificateRequest has no ExtKeyUsage field of its own (unlike
+// x509.Certificate), so a CSR that needs to constrain its extended key
+// usage, e.g. for ACME, must encode this extension by hand.
+var extKeyUsageOID = asn1.ObjectIdentifier{2, 5, 29, 37}
+
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageAny:                            {2, 5, 29, 37, 0},
+	x509.ExtKeyUsageServerAuth:                     {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth:                     {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	x509.ExtKeyUsageCodeSigning:                    {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	x509.ExtKeyUsageEmailProtection:                {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	x509.ExtKeyUsageIPSECEndSystem:                 {1, 3, 6, 1, 5, 5, 7, 3, 5},
+	x509.ExtKeyUsageIPSECTunnel:                    {1, 3, 6, 1, 5, 5, 7, 3, 6},
+	x509.ExtKeyUsageIPSECUser:                      {1, 3, 6, 1, 5, 5, 7, 3, 7},
+	x509.ExtKeyUsageTimeStamping:                   {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:                    {1, 3, 6, 1, 5, 5, 7, 3, 9},
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     {1, 3, 6, 1, 4, 1, 311, 10, 3, 3},
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      {2, 16, 840, 1, 113730, 4, 1},
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: {1, 3, 6, 1, 4, 1, 311, 2, 1, 22},
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     {1, 3, 6, 1, 4, 1, 311, 61, 1, 1},
+}
+
+// marshalExtKeyUsage encodes extKeyUsage as a certificate extension
+// (SEQUENCE OF OBJECT IDENTIFIER).
+func marshalExtKeyUsage(extKeyUsage []x509.ExtKeyUsage) (pkix.Extension, error) {
+	oids := make([]asn1.ObjectIdentifier, 0, len(extKeyUsage))
+	for _, usage := range extKeyUsage {
+		oid, ok := extKeyUsageOIDs[usage]
+		if !ok {
+			return pkix.Extension{}, fmt.Errorf("unknown extended key usage %v", usage)
+		}
+		oids = append(oids, oid)
+	}
+
+	value, err := asn1.Marshal(oids)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: extKeyUsageOID, Value: value}, nil
+}
+
+func firstOrEmpty(s []string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
+
+func pemEncode(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func decodePEM(data []byte) ([]byte, []byte) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, rest
+	}
+	return block.Bytes, rest
+}
@@ -22,6 +22,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"io/fs"
 	"math/big"
@@ -34,7 +35,10 @@ import (
 	"testing"
 	"time"
 
+	keystore "github.com/pavlo-v-chernykh/keystore-go/v4"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 func TestManifestHandling(t *testing.T) {
@@ -156,6 +160,11 @@ func TestParsingAllCertificateFields(t *testing.T) {
 	assert.Nil(t, err)
 	defer os.RemoveAll(dir)
 
+	// rsa-cert carries ct_logs:, so every generation in this test goes
+	// through the CT precertificate flow; install the fake log for the
+	// whole test rather than hitting a real one.
+	defer useFakeCTLog(t)()
+
 	var output bytes.Buffer
 	err = GenerateCertificates(&output, "testdata/certs-test-all-fields.yaml", path.Join(dir, "state.yaml"), dir)
 	assert.Nil(t, err)
@@ -253,6 +262,46 @@ func TestParsingAllCertificateFields(t *testing.T) {
 	assert.Equal(t, "ed25519-cert", got.Issuer.CommonName)
 	assert.Equal(t, "ed25519-cert", got.Subject.CommonName)
 	assert.Equal(t, x509.Ed25519, got.PublicKeyAlgorithm)
+
+	// Check that rsa-cert, configured with ct_logs, embedded an SCT list
+	// extension obtained from the fake log instead of hitting a real one.
+	tlsCert, err = tls.LoadX509KeyPair(path.Join(dir, "rsa-cert.pem"), path.Join(dir, "rsa-cert-key.pem"))
+	assert.Nil(t, err)
+	got, err = x509.ParseCertificate(tlsCert.Certificate[0])
+	assert.Nil(t, err)
+
+	var sctExtension []byte
+	for _, ext := range got.Extensions {
+		if ext.Id.Equal(ctSCTListOID) {
+			sctExtension = ext.Value
+		}
+	}
+	assert.NotEmpty(t, sctExtension)
+}
+
+// useFakeCTLog overrides the package's add-pre-chain boundary with an
+// in-memory fake so tests can verify SCT embedding without a network call,
+// mirroring the stub pattern used by x/crypto/acme/autocert's test suite.
+// It returns a function that restores the real implementation.
+func useFakeCTLog(t *testing.T) func() {
+	t.Helper()
+	original := addPreChain
+	addPreChain = func(logURL string, der, issuerDER []byte) ([]byte, error) {
+		sum := sha256.Sum256(der)
+		sct := SignedCertificateTimestamp{
+			Version:   0,
+			LogID:     sha256.Sum256([]byte(logURL)),
+			Timestamp: 0,
+			Signature: sum[:],
+		}
+		return encodeSCT(addPreChainResponse{
+			SCTVersion: sct.Version,
+			ID:         base64.StdEncoding.EncodeToString(sct.LogID[:]),
+			Timestamp:  sct.Timestamp,
+			Signature:  base64.StdEncoding.EncodeToString(sct.Signature),
+		})
+	}
+	return func() { addPreChain = original }
 }
 
 func TestRevocation(t *testing.T) {
@@ -290,6 +339,86 @@ func TestRevocation(t *testing.T) {
 	assert.Equal(t, 2, len(certList.RevokedCertificateEntries))
 	assert.Equal(t, big.NewInt(123), certList.RevokedCertificateEntries[0].SerialNumber)
 	assert.Equal(t, big.NewInt(456), certList.RevokedCertificateEntries[1].SerialNumber)
+
+	// Check that an OCSP response was produced alongside the CRL for the CA
+	// that has revoked certs.
+	ocspFile := path.Join(dir, "ca1-ocsp.der")
+	ocspBuffer, err := os.ReadFile(ocspFile)
+	assert.Nil(t, err)
+	resp, err := ocsp.ParseResponse(ocspBuffer, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, big.NewInt(123), resp.SerialNumber)
+	assert.Equal(t, ocsp.Revoked, resp.Status)
+}
+
+// TestOCSPDelegatedSigner verifies that setting ocsp_signer: true on a CA
+// makes it generate and use a delegated OCSP signing certificate for its
+// own responses, instead of signing them with the CA key directly.
+func TestOCSPDelegatedSigner(t *testing.T) {
+	dir, err := os.MkdirTemp("", "certyaml-testsuite-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var output bytes.Buffer
+	err = GenerateCertificates(&output, "testdata/certs-ocsp-signer.yaml", path.Join(dir, "state.yaml"), dir)
+	assert.Nil(t, err)
+
+	// The delegate's key must have been written alongside the CA's own
+	// output files.
+	_, err = os.Stat(path.Join(dir, "ca1-ocsp-key.pem"))
+	assert.Nil(t, err)
+
+	caPEM, err := os.ReadFile(path.Join(dir, "ca1.pem"))
+	assert.Nil(t, err)
+	caBlock, _ := pem.Decode(caPEM)
+	caCert, err := x509.ParseCertificate(caBlock.Bytes)
+	assert.Nil(t, err)
+
+	ocspBuffer, err := os.ReadFile(path.Join(dir, "ca1-ocsp.der"))
+	assert.Nil(t, err)
+	resp, err := ocsp.ParseResponse(ocspBuffer, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, big.NewInt(123), resp.SerialNumber)
+	assert.NotEqual(t, caCert.RawSubject, resp.RawResponderName, "response should be signed by the delegated signer, not the CA itself")
+}
+
+func TestBundleOutputs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "certyaml-testsuite-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var output bytes.Buffer
+	err = GenerateCertificates(&output, "testdata/certs-bundles.yaml", path.Join(dir, "state.yaml"), dir)
+	assert.Nil(t, err)
+
+	p12Data, err := os.ReadFile(path.Join(dir, "myserver.p12"))
+	assert.Nil(t, err)
+	p12Key, p12Cert, p12Chain, err := pkcs12.DecodeChain(p12Data, "changeit")
+	assert.Nil(t, err)
+	assert.NotNil(t, p12Key)
+
+	pemCert, err := os.ReadFile(path.Join(dir, "myserver.pem"))
+	assert.Nil(t, err)
+	block, _ := pem.Decode(pemCert)
+	assert.Equal(t, block.Bytes, p12Cert.Raw)
+	assert.NotEmpty(t, p12Chain)
+
+	jksFile, err := os.Open(path.Join(dir, "myserver.jks"))
+	assert.Nil(t, err)
+	defer jksFile.Close()
+
+	ks := keystore.New()
+	assert.Nil(t, ks.Load(jksFile, []byte("changeit")))
+
+	entry, err := ks.GetPrivateKeyEntry("myserver", []byte("changeit"))
+	assert.Nil(t, err)
+	assert.Equal(t, block.Bytes, entry.CertificateChain[0].Content)
+	assert.Greater(t, len(entry.CertificateChain), 1, "chain entries should have been included")
+
+	pemKey, err := os.ReadFile(path.Join(dir, "myserver-key.pem"))
+	assert.Nil(t, err)
+	keyBlock, _ := pem.Decode(pemKey)
+	assert.Equal(t, keyBlock.Bytes, entry.PrivateKey)
 }
 
 func TestInvalidRevocation(t *testing.T) {
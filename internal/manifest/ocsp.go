@@ -0,0 +1,87 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspValidity is the interval between ThisUpdate and NextUpdate in a
+// produced OCSP response. Responses are re-signed on every generator run;
+// an earlier response is not reused within this window.
+const ocspValidity = 7 * 24 * time.Hour
+
+// OCSPState is the state file's record of when an OCSP response for a CA
+// was produced and when it is due for refresh. It is carried over between
+// runs; generation does not set it or consult it.
+type OCSPState struct {
+	ProducedAt time.Time `yaml:"produced_at"`
+	NextUpdate time.Time `yaml:"next_update"`
+}
+
+// OCSPResponse returns a DER-encoded OCSP response covering serial, signed
+// by the issuing CA's key, or by the CA's delegated OCSP signer when it has
+// one.
+func (c *Certificate) OCSPResponse(serial *big.Int) ([]byte, error) {
+	issuer := c.issuer()
+	if issuer == nil {
+		return nil, fmt.Errorf("ocsp: %s has no issuer to produce an OCSP response for", c.Name)
+	}
+
+	status := ocsp.Good
+	var revokedAt time.Time
+	if r, ok := issuer.revokedSerials()[serial.String()]; ok {
+		status = ocsp.Revoked
+		revokedAt = r
+	}
+
+	signerCert, signerKey := issuer.certificate, issuer.key
+	if issuer.OCSPSigner != nil {
+		signerCert, signerKey = issuer.OCSPSigner.certificate, issuer.OCSPSigner.key
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:           status,
+		SerialNumber:     serial,
+		ThisUpdate:       now,
+		NextUpdate:       now.Add(ocspValidity),
+		RevokedAt:        revokedAt,
+		RevocationReason: ocsp.Unspecified,
+	}
+
+	return ocsp.CreateResponse(issuer.certificate, signerCert, template, signerKey)
+}
+
+// ocspResponseFilename and ocspSignerKeyFilename follow the existing
+// "[issuer]-crl.pem" naming convention used for CRLs.
+func ocspResponseFilename(issuer string) string {
+	return issuer + "-ocsp.der"
+}
+
+func ocspSignerKeyFilename(issuer string) string {
+	return issuer + "-ocsp-key.pem"
+}
+
+// shouldWriteOCSP reports whether a CA should have an OCSP response
+// generated for it: either it has revoked certificates, or ocsp: true was
+// set explicitly in the manifest.
+func shouldWriteOCSP(c *Certificate) bool {
+	return c.OCSP || len(c.revokedSerials()) > 0
+}
@@ -0,0 +1,309 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// WatchOptions configures GenerateCertificatesWatch.
+type WatchOptions struct {
+	// AdminAddr, if non-empty, serves a /certs/reload endpoint that
+	// triggers an immediate re-check when requested.
+	AdminAddr string
+	// OnRegenerated, if set, is called after every successful generation
+	// (including the initial one) with the list of output files that
+	// changed, so callers can reload a server that consumes them.
+	OnRegenerated OnRegeneratedFunc
+}
+
+// OnRegeneratedFunc is called with the list of output files that changed
+// each time GenerateCertificatesWatch re-runs the generator.
+type OnRegeneratedFunc func(changedFiles []string)
+
+// GenerateCertificatesWatch runs GenerateCertificates once, then keeps the
+// process alive, re-running it whenever the manifest (or any file it
+// includes) changes on disk, or when a certificate approaches its
+// renew_before window, whichever comes first. It returns only when ctx is
+// cancelled or a fatal error occurs.
+func GenerateCertificatesWatch(ctx context.Context, output io.Writer, manifestPath, statePath, destDir string, opts WatchOptions) error {
+	onRegenerated := opts.OnRegenerated
+	if onRegenerated == nil {
+		onRegenerated = func([]string) {}
+	}
+
+	// Serializes all regenerate() calls: fsnotify events, the renewal
+	// timer and the admin endpoint can each trigger one concurrently, and
+	// GenerateCertificates is not safe to run against the same destDir
+	// and state file from multiple goroutines at once.
+	var regenerateMu sync.Mutex
+	regenerate := func() ([]string, error) {
+		regenerateMu.Lock()
+		defer regenerateMu.Unlock()
+
+		before, err := snapshotDestDir(destDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := GenerateCertificates(output, manifestPath, statePath, destDir); err != nil {
+			return nil, err
+		}
+		return diffDestDir(before, destDir)
+	}
+
+	changed, err := regenerate()
+	if err != nil {
+		return fmt.Errorf("watch: initial generation: %w", err)
+	}
+	onRegenerated(changed)
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch: creating fsnotify watcher: %w", err)
+	}
+	defer fsw.Close()
+
+	watched := watchedFiles(manifestPath)
+	for _, f := range watched {
+		if err := fsw.Add(f); err != nil {
+			return fmt.Errorf("watch: watching %s: %w", f, err)
+		}
+	}
+
+	if opts.AdminAddr != "" {
+		reloadNow := make(chan struct{}, 1)
+		go serveAdminEndpoint(ctx, opts.AdminAddr, reloadNow)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case _, ok := <-reloadNow:
+					if !ok {
+						return
+					}
+					if changed, err := regenerate(); err == nil {
+						onRegenerated(changed)
+					}
+				}
+			}
+		}()
+	}
+
+	timer := time.NewTimer(nextWakeup(statePath))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return fmt.Errorf("watch: fsnotify event channel closed")
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			// A Rename (the common atomic-save pattern: write a temp
+			// file, then rename it over the watched path) detaches
+			// fsnotify's watch from the new inode, so the watch must be
+			// re-established or further edits go unnoticed.
+			if event.Op&fsnotify.Rename != 0 {
+				fsw.Add(event.Name)
+			}
+			changed, err := regenerate()
+			if err != nil {
+				return fmt.Errorf("watch: regenerating after %s: %w", event.Name, err)
+			}
+			onRegenerated(changed)
+			timer.Reset(nextWakeup(statePath))
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return fmt.Errorf("watch: fsnotify error channel closed")
+			}
+			return fmt.Errorf("watch: fsnotify: %w", err)
+		case <-timer.C:
+			changed, err := regenerate()
+			if err != nil {
+				return fmt.Errorf("watch: renewing short-lived certificates: %w", err)
+			}
+			onRegenerated(changed)
+			timer.Reset(nextWakeup(statePath))
+		}
+	}
+}
+
+// watchedFiles returns manifestPath plus every file its certificates
+// reference (ACME account keys, bundle password files), so editing one of
+// those also triggers regeneration.
+func watchedFiles(manifestPath string) []string {
+	files := []string{manifestPath}
+	includes, err := manifestIncludes(manifestPath)
+	if err == nil {
+		files = append(files, includes...)
+	}
+	return files
+}
+
+// manifestIncludes returns the paths of files a manifest's certificates
+// depend on besides the manifest itself.
+func manifestIncludes(manifestPath string) ([]string, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	var includes []string
+	for _, spec := range manifest {
+		if spec.Acme != nil && spec.Acme.AccountKey != "" {
+			includes = append(includes, spec.Acme.AccountKey)
+		}
+		for _, bundle := range spec.Bundles {
+			if bundle.PasswordFile != "" {
+				includes = append(includes, bundle.PasswordFile)
+			}
+		}
+	}
+	return includes, nil
+}
+
+// snapshotDestDir hashes the contents of every regular file directly under
+// destDir, so a later call to diffDestDir can report exactly which output
+// files a regeneration touched.
+func snapshotDestDir(destDir string) (map[string]string, error) {
+	hashes := map[string]string{}
+	if destDir == "" {
+		return hashes, nil
+	}
+
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		return nil, fmt.Errorf("watch: reading %s: %w", destDir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(destDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		hashes[entry.Name()] = fmt.Sprintf("%x", sum)
+	}
+	return hashes, nil
+}
+
+// diffDestDir compares before (a snapshot taken just before regeneration)
+// against the current contents of destDir, returning the names of every
+// file that was added or changed.
+func diffDestDir(before map[string]string, destDir string) ([]string, error) {
+	after, err := snapshotDestDir(destDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for name, hash := range after {
+		if before[name] != hash {
+			changed = append(changed, name)
+		}
+	}
+	sortStrings(changed)
+	return changed, nil
+}
+
+// soonestRenewal returns the shortest time until any certificate recorded
+// in the state file reaches its renewal deadline, i.e. its NotAfter minus
+// its own renew_before window, not NotAfter itself.
+func soonestRenewal(statePath string) (time.Duration, error) {
+	state, err := loadState(statePath)
+	if err != nil {
+		return 0, err
+	}
+
+	var soonest time.Duration
+	found := false
+	now := time.Now()
+	for _, certState := range state.Certificates {
+		if certState.NotAfter.IsZero() {
+			continue
+		}
+		remaining := certState.NotAfter.Add(-certState.RenewBefore).Sub(now)
+		if !found || remaining < soonest {
+			soonest = remaining
+			found = true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("watch: no certificate deadlines recorded in state")
+	}
+	return soonest, nil
+}
+
+// nextWakeup returns the duration until the soonest certificate deadline
+// recorded in the state file, so short-lived certificates are renewed
+// without an external cron. It falls back to a conservative default when
+// the state cannot be read or is empty, and clamps non-positive durations
+// up to an immediate retry.
+func nextWakeup(statePath string) time.Duration {
+	soonest, err := soonestRenewal(statePath)
+	if err != nil {
+		return time.Hour
+	}
+	if soonest <= 0 {
+		return time.Second
+	}
+	return soonest
+}
+
+// serveAdminEndpoint serves /certs/reload (any HTTP method) until ctx is
+// cancelled. Each request signals reloadNow unless a reload is already
+// pending, in which case the request is answered without a new signal.
+func serveAdminEndpoint(ctx context.Context, addr string, reloadNow chan<- struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/certs/reload", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case reloadNow <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "watch: admin endpoint on %s: %v\n", addr, err)
+	}
+}
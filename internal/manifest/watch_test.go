@@ -0,0 +1,170 @@
+// Copyright certyaml authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextWakeupFallsBackWhenStateIsEmpty(t *testing.T) {
+	dir, err := os.MkdirTemp("", "certyaml-watch-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Equal(t, time.Hour, nextWakeup(path.Join(dir, "does-not-exist.yaml")))
+}
+
+func TestNextWakeupTracksSoonestDeadline(t *testing.T) {
+	dir, err := os.MkdirTemp("", "certyaml-watch-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	statePath := path.Join(dir, "state.yaml")
+	state := &State{Certificates: map[string]*CertState{
+		// Due in an hour, but only 5 minutes before the deadline does it
+		// count as needing renewal.
+		"far": {NotAfter: time.Now().Add(time.Hour), RenewBefore: 5 * time.Minute},
+		// Due in 10 minutes, with no renew_before: this is the soonest
+		// deadline once renew_before is accounted for.
+		"soon": {NotAfter: time.Now().Add(10 * time.Minute)},
+	}}
+	assert.Nil(t, saveState(statePath, state))
+
+	wakeup := nextWakeup(statePath)
+	assert.True(t, wakeup > 0 && wakeup <= 10*time.Minute, "wakeup %s should track the soonest deadline, not the far one", wakeup)
+}
+
+func TestNextWakeupClampsPastDeadlines(t *testing.T) {
+	dir, err := os.MkdirTemp("", "certyaml-watch-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	statePath := path.Join(dir, "state.yaml")
+	state := &State{Certificates: map[string]*CertState{
+		// Already past its renewal deadline once renew_before is
+		// subtracted, even though NotAfter itself is still in the future.
+		"overdue": {NotAfter: time.Now().Add(time.Minute), RenewBefore: 5 * time.Minute},
+	}}
+	assert.Nil(t, saveState(statePath, state))
+
+	assert.Equal(t, time.Second, nextWakeup(statePath))
+}
+
+// TestGenerateCertificatesWatchRenewsShortLivedCert exercises the renewal
+// timer end to end: a certificate whose whole lifetime is shorter than the
+// test should be regenerated without any manifest change or fsnotify event.
+func TestGenerateCertificatesWatchRenewsShortLivedCert(t *testing.T) {
+	dir, err := os.MkdirTemp("", "certyaml-watch-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	manifestPath := path.Join(dir, "manifest.yaml")
+	assert.Nil(t, os.WriteFile(manifestPath, []byte(`- name: shortlived
+  subject: CN=shortlived
+  expires: 1s
+`), 0644))
+	statePath := path.Join(dir, "state.yaml")
+
+	var mu sync.Mutex
+	regenerations := 0
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var output bytes.Buffer
+	err = GenerateCertificatesWatch(ctx, &output, manifestPath, statePath, dir, WatchOptions{
+		OnRegenerated: func([]string) {
+			mu.Lock()
+			defer mu.Unlock()
+			regenerations++
+			if regenerations >= 2 {
+				cancel()
+			}
+		},
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.GreaterOrEqual(t, regenerations, 2, "a 1s-lived certificate should have been renewed at least once")
+}
+
+// TestGenerateCertificatesWatchAdminReload verifies that POSTing to the
+// admin endpoint's /certs/reload triggers an immediate regeneration without
+// waiting for the renewal timer or a manifest change.
+func TestGenerateCertificatesWatchAdminReload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "certyaml-watch-*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	manifestPath := path.Join(dir, "manifest.yaml")
+	assert.Nil(t, os.WriteFile(manifestPath, []byte(`- name: selfsigned
+  subject: CN=selfsigned
+`), 0644))
+	statePath := path.Join(dir, "state.yaml")
+
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	var mu sync.Mutex
+	regenerations := 0
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	var output bytes.Buffer
+	go func() {
+		done <- GenerateCertificatesWatch(ctx, &output, manifestPath, statePath, dir, WatchOptions{
+			AdminAddr: adminAddr,
+			OnRegenerated: func([]string) {
+				mu.Lock()
+				defer mu.Unlock()
+				regenerations++
+			},
+		})
+	}()
+
+	// Give the admin endpoint a moment to start listening.
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = http.Post(fmt.Sprintf("http://%s/certs/reload", adminAddr), "", nil)
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Nil(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+
+	// Give the reload goroutine a moment to run before tearing down.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.GreaterOrEqual(t, regenerations, 2, "initial generation plus the triggered reload")
+}